@@ -2,23 +2,41 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"hash/adler32"
 	"io"
-	"math"
+	"net/http"
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"text/template"
 	"time"
-)
 
-const maxSize = int64(math.MaxInt32) // ~1.99 Gbyte
+	"github.com/klauspost/compress/zstd"
+)
 
 const defaultPkgName = "vfs"
 
+const (
+	codecNone = "none"
+	codecGzip = "gzip"
+	codecZstd = "zstd"
+)
+
+const (
+	encodingQuote  = "quote"
+	encodingBase64 = "base64"
+	encodingEmbed  = "embed"
+)
+
 const usage = `NAME
 
 	govfs - generate a virtual file system by embedding files and directories
@@ -44,10 +62,53 @@ DESCRIPTION
 
 	Multiple PATTERN::TARGETDIR pairs can be specified.
 
-	The virtual file system will only be generated if the 
+	A mapping can opt out of the -compress codec by appending
+	::nocompress, for example PATTERN::TARGETDIR::nocompress.
+	This is useful for assets that are already compressed,
+	such as PNGs.
+
+	A mapping can also attach per-file metadata by appending
+	::meta=path/to/tags.json, for example
+	PATTERN::TARGETDIR::meta=tags.json. The file is a JSON
+	object mapping a glob pattern to {"tags": [...],
+	"cacheControl": "..."}. A pattern without a slash, such as
+	"*.css", is matched against just the file's base name, so it
+	applies regardless of which directory the file lives in; a
+	pattern containing a slash is matched against the file's
+	whole path relative to the source. When multiple patterns
+	match the same file, their tags are combined and the
+	patterns are applied in lexical order, so the cacheControl
+	of the lexically last matching pattern wins; the order of
+	entries in the JSON file plays no part. Tags are exposed
+	through File.Tag at run time.
+
+	By default file contents are emitted as a quoted Go string
+	literal, which is fast to compile and compact. Pass
+	-base64 to emit a base64 string decoded at init instead, or
+	-embed to stage the files next to the output file and pull
+	them in with //go:embed. -base64 and -embed are mutually
+	exclusive.
+
+	Pass -overlay to also generate a writable, in-memory
+	overlay on top of the embedded store, useful as a test
+	double for packages that expect a writable file system.
+
+	For large embedded payloads, -shard-bytes and -shard-files
+	split the store across vfs.go plus sibling
+	vfs_data_001.go, vfs_data_002.go, ... files so no single
+	file grows large enough to slow down the Go compiler or
+	editors. Each shard file merges its files into the central
+	store from its own init function.
+
+	Each embedded file's mode and modification time are
+	captured from the source file, and its content type is
+	sniffed from its contents. These are exposed at run time
+	through File.Mode, File.ModTime and File.ContentType.
+
+	The virtual file system will only be generated if the
 	option -o is specified.
 
-	The io.Reader, io.Seeker and io.ReadSeeker interfaces are 
+	The io.Reader, io.Seeker and io.ReadSeeker interfaces are
 	supported by a virtual file.
 
 OPTIONS
@@ -62,9 +123,15 @@ func printUsage() {
 func main() {
 	flag.Usage = printUsage
 	var (
-		output   string
-		pkgName  string
-		testFile string
+		output     string
+		pkgName    string
+		testFile   string
+		compress   string
+		base64Flag bool
+		embedFlag  bool
+		overlay    bool
+		shardBytes int64
+		shardFiles int
 	)
 
 	flag.StringVar(&output, "o", "",
@@ -75,6 +142,29 @@ func main() {
 		"path to a file in the virtual file system "+
 			"that will be used to generate tests, "+
 			"interpreted only if option -o is specified")
+	flag.StringVar(&compress, "compress", codecNone,
+		"compress file contents with the given codec "+
+			"(gzip, zstd or none) and decompress "+
+			"transparently on Read; a mapping can opt out "+
+			"with ::nocompress")
+	flag.BoolVar(&base64Flag, "base64", false,
+		"encode file contents as base64, decoded at init "+
+			"(default: a quoted Go string literal)")
+	flag.BoolVar(&embedFlag, "embed", false,
+		"stage file contents next to the output file and "+
+			"pull them in with //go:embed "+
+			"(default: a quoted Go string literal)")
+	flag.BoolVar(&overlay, "overlay", false,
+		"also generate a writable, in-memory overlay on top "+
+			"of the embedded store (see NewOverlay)")
+	flag.Int64Var(&shardBytes, "shard-bytes", 0,
+		"rotate embedded file contents into a new "+
+			"vfs_data_NNN.go file after approximately N bytes "+
+			"(0 disables byte-based sharding)")
+	flag.IntVar(&shardFiles, "shard-files", 0,
+		"rotate embedded file contents into a new "+
+			"vfs_data_NNN.go file after N embedded files "+
+			"(0 disables count-based sharding)")
 	flag.Parse()
 
 	if len(flag.Args()) == 0 {
@@ -88,9 +178,40 @@ func main() {
 		pkgName = defaultPkgName
 	}
 
+	compress = strings.TrimSpace(compress)
+	switch compress {
+	case codecNone, codecGzip, codecZstd:
+	default:
+		errorExit("invalid -compress codec: %s", compress)
+	}
+
+	if base64Flag && embedFlag {
+		errorExit("-base64 and -embed are mutually exclusive")
+	}
+	if shardBytes < 0 {
+		errorExit("invalid -shard-bytes: %d", shardBytes)
+	}
+	if shardFiles < 0 {
+		errorExit("invalid -shard-files: %d", shardFiles)
+	}
+	encoding := encodingQuote
+	if base64Flag {
+		encoding = encodingBase64
+	}
+	if embedFlag {
+		encoding = encodingEmbed
+	}
+
 	v := &vfs{
-		mappings: resolveSources(flag.Args()),
-		pkgName:  pkgName,
+		mappings:        resolveSources(flag.Args()),
+		pkgName:         pkgName,
+		compress:        compress,
+		encoding:        encoding,
+		overlay:         overlay,
+		outputPath:      strings.TrimSpace(output),
+		outputDir:       filepath.Dir(strings.TrimSpace(output)),
+		shardBytesLimit: shardBytes,
+		shardFilesLimit: shardFiles,
 	}
 
 	var w *bufio.Writer
@@ -138,45 +259,110 @@ func main() {
 func resolveSources(args []string) []*mapping {
 	mappings := []*mapping{}
 	for _, a := range args {
-		i := strings.LastIndex(a, "::")
-		if i == -1 {
+		parts := strings.Split(a, "::")
+		noCompress := false
+		metaPath := ""
+		if len(parts) == 3 {
+			opt := strings.TrimSpace(parts[2])
+			switch {
+			case opt == "nocompress":
+				noCompress = true
+			case strings.HasPrefix(opt, "meta="):
+				metaPath = strings.TrimSpace(strings.TrimPrefix(opt, "meta="))
+			default:
+				errorExit("invalid mapping: %s", a)
+			}
+			parts = parts[:2]
+		}
+		if len(parts) != 2 {
 			errorExit("invalid mapping: %s", a)
 		}
-		src := strings.TrimSpace(a[0:i])
-		targetDir := strings.TrimSpace(a[i+2:])
+		src := strings.TrimSpace(parts[0])
+		targetDir := strings.TrimSpace(parts[1])
 		if src == "" || targetDir == "" || strings.Index(targetDir, `\`) != -1 || targetDir[0] != '/' {
 			errorExit("invalid mapping: %s", a)
 		}
 		targetDir = path.Clean(targetDir)
 		matches, err := filepath.Glob(src)
 		handleError(err, "invalid mapping: %s", a)
-		mappings = append(mappings, &mapping{src: matches, targetDir: targetDir, pattern: a})
+
+		var meta map[string]tagMeta
+		if metaPath != "" {
+			meta, err = loadMeta(metaPath)
+			handleError(err, "could not load metadata: %s", metaPath)
+		}
+
+		mappings = append(mappings, &mapping{src: matches, targetDir: targetDir, pattern: a, noCompress: noCompress, meta: meta})
 	}
 	return mappings
 }
 
 type mapping struct {
-	src       []string
-	targetDir string
-	pattern   string
+	src        []string
+	targetDir  string
+	pattern    string
+	noCompress bool
+	meta       map[string]tagMeta
+}
+
+// tagMeta describes the metadata attached to files matching a glob
+// pattern in a ::meta=path/to/tags.json file.
+type tagMeta struct {
+	Tags         []string `json:"tags"`
+	CacheControl string   `json:"cacheControl"`
+}
+
+// loadMeta reads and parses a ::meta metadata file, mapping glob
+// pattern to the tags it attaches.
+func loadMeta(path string) (map[string]tagMeta, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	meta := map[string]tagMeta{}
+	if err := json.Unmarshal(b, &meta); err != nil {
+		return nil, err
+	}
+	return meta, nil
 }
 
 type file struct {
 	path    string
 	size    int64
 	version string
+	modTime time.Time
 }
 
 type vfs struct {
-	mappings  []*mapping
-	w         io.Writer
-	pkgName   string
-	processed map[string]*file
-	buf       []byte
+	mappings        []*mapping
+	w               io.Writer
+	pkgName         string
+	compress        string
+	encoding        string
+	overlay         bool
+	outputPath      string
+	outputDir       string
+	shardBytesLimit int64
+	shardFilesLimit int
+	processed       map[string]*file
+	dirs            map[string]bool
+	embeds          []embedAsset
+	genTime         time.Time
+	buf             []byte
+
+	dataW              io.Writer
+	shardFile          *os.File
+	shardBufWriter     *bufio.Writer
+	shardIndex         int
+	shardByteCount     int64
+	shardFileCount     int
+	shardRotatePending bool
 }
 
 func (v *vfs) Generate() {
 	v.processed = map[string]*file{}
+	v.dirs = map[string]bool{}
+	v.genTime = time.Now()
 	v.buf = make([]byte, 4096)
 
 	err := v.writeHeader()
@@ -186,12 +372,16 @@ func (v *vfs) Generate() {
 		if len(m.src) == 0 {
 			fmt.Println("skip mapping, no matches:", m.pattern)
 		}
+		codec := v.compress
+		if m.noCompress {
+			codec = codecNone
+		}
 		for _, s := range m.src {
 			stat, err := os.Stat(s)
 			handleError(err, "stat error: %s", s)
 
 			if stat.Mode().IsRegular() || stat.Mode().IsDir() {
-				v.walk(m.targetDir, s)
+				v.walk(m.targetDir, s, codec, m.meta)
 			} else {
 				fmt.Println("skip source, not a regular file or directory:", s)
 			}
@@ -202,7 +392,7 @@ func (v *vfs) Generate() {
 	handleError(err, "could not write")
 }
 
-func (v *vfs) walk(targetDir string, src string) {
+func (v *vfs) walk(targetDir string, src string, codec string, meta map[string]tagMeta) {
 	base := filepath.Base(src)
 
 	err := filepath.Walk(src, func(p string, info os.FileInfo, err error) error {
@@ -219,13 +409,20 @@ func (v *vfs) walk(targetDir string, src string) {
 				errorExit("target already exists: %s", target)
 			} else {
 				fmt.Println(p, " -> ", target)
-				version, err := v.writeFile(target, p, info.Size())
+				metaRel := rel
+				if metaRel == "." {
+					metaRel = base
+				}
+				tags := matchTags(metaRel, meta)
+				version, err := v.writeFile(target, p, info, codec, tags)
 				handleError(err, "could not write: %s", target)
 				v.processed[target] = &file{
 					path:    target,
 					size:    info.Size(),
 					version: version,
+					modTime: info.ModTime(),
 				}
+				v.recordDirs(target)
 			}
 		}
 		return nil
@@ -233,6 +430,65 @@ func (v *vfs) walk(targetDir string, src string) {
 	handleError(err, "could not visit: %s", src)
 }
 
+// matchTags resolves the tags attached to rel, the file's path
+// relative to its mapping's source (its base name when the source
+// is the file itself), by matching it against every glob key in
+// meta in lexical order. Tags of all matching patterns are
+// combined, and the cacheControl of the last matching pattern in
+// that order wins. A pattern without a slash,
+// such as "*.css", is matched against rel's base name so it applies
+// regardless of directory; a pattern containing a slash is matched
+// against rel in full.
+func matchTags(rel string, meta map[string]tagMeta) map[string]string {
+	if len(meta) == 0 {
+		return nil
+	}
+	patterns := make([]string, 0, len(meta))
+	for pattern := range meta {
+		patterns = append(patterns, pattern)
+	}
+	sort.Strings(patterns)
+
+	base := path.Base(rel)
+	tags := map[string]string{}
+	for _, pattern := range patterns {
+		candidate := rel
+		if !strings.Contains(pattern, "/") {
+			candidate = base
+		}
+		ok, err := path.Match(pattern, candidate)
+		handleError(err, "invalid meta pattern: %s", pattern)
+		if !ok {
+			continue
+		}
+		m := meta[pattern]
+		for _, t := range m.Tags {
+			tags[t] = "true"
+		}
+		if m.CacheControl != "" {
+			tags["cacheControl"] = m.CacheControl
+		}
+	}
+	if len(tags) == 0 {
+		return nil
+	}
+	return tags
+}
+
+// recordDirs registers target's parent directories, all the way up
+// to the virtual root "/", so the generator can synthesize
+// directory entries for them.
+func (v *vfs) recordDirs(target string) {
+	d := path.Dir(target)
+	for {
+		v.dirs[d] = true
+		if d == "/" {
+			return
+		}
+		d = path.Dir(d)
+	}
+}
+
 func (v *vfs) writeHeader() error {
 	if v.w == nil {
 		return nil
@@ -245,6 +501,8 @@ func (v *vfs) writeHeader() error {
 	data := map[string]interface{}{
 		"ts":      time.Now().Format(time.RFC3339),
 		"pkgName": v.pkgName,
+		"embed":   v.encoding == encodingEmbed,
+		"overlay": v.overlay,
 	}
 
 	return tmpl.Execute(v.w, data)
@@ -256,18 +514,29 @@ var tmplHeader = `// Code generated with govfs. DO NOT EDIT.
 package {{.pkgName}}
 
 import (
+{{if .embed}}	_ "embed"
+{{end}}	"bytes"
+	"compress/gzip"
+	"encoding/base64"
 	"fmt"
 	"io"
-	"math"
-)
+	"io/fs"
+{{if .overlay}}	"net/http"
+{{end}}	"path"
+	"sort"
+	"strings"
+{{if .overlay}}	"sync"
+{{end}}	"time"
 
-const maxSize = int64(math.MaxInt32) // ~1.99 GiB
+	"github.com/klauspost/compress/zstd"
+)
 
 // File represents an open file descriptor.
 type File struct {
 	f *file
 	path string
 	offset int64
+	decoded []byte
 }
 
 // Open opens a file. If the version is specified it must match 
@@ -297,17 +566,37 @@ func (f *File) Version() string {
 	return f.f.version
 }
 
-// Size returns the number of bytes of the file contents.
+// Size returns the number of bytes of the uncompressed file
+// contents.
 func (f *File) Size() int64 {
-	return int64(len(f.f.contents))
+	return f.f.size
+}
+
+// data returns the uncompressed contents of the file, decoding
+// and caching them on the File instance on first use so repeated
+// Read and Seek calls don't pay the decompression cost again.
+func (f *File) data() ([]byte, error) {
+	if f.decoded == nil {
+		data, err := decompress(f.f.contents, f.f.codec)
+		if err != nil {
+			return nil, err
+		}
+		f.decoded = data
+	}
+	return f.decoded, nil
 }
 
-// Read reads up to len(b) bytes into b. It returns the 
-// number of bytes read (0 <= n <= len(b)) and any 
+// Read reads up to len(b) bytes into b. It returns the
+// number of bytes read (0 <= n <= len(b)) and any
 // error encountered.
 func (f *File) Read(b []byte) (int, error) {
+	data, err := f.data()
+	if err != nil {
+		return 0, err
+	}
+
 	bufLen := len(b)
-	available := len(f.f.contents) - int(f.offset)
+	available := len(data) - int(f.offset)
 	if available == 0 {
 		return 0, io.EOF
 	}
@@ -317,33 +606,35 @@ func (f *File) Read(b []byte) (int, error) {
 		canRead = bufLen
 	}
 
-	copy(b, f.f.contents[int(f.offset): int(f.offset)+canRead])
+	copy(b, data[int(f.offset): int(f.offset)+canRead])
 	f.offset += int64(canRead)
 	return canRead, nil
 }
 
-// Seek sets the offset for the next Read to offset, 
-// interpreted according to whence: io.SeekStart means 
-// relative to the start of the file, io.SeekCurrent means 
-// relative to the current offset, and io.SeekEnd means 
-// relative to the end. Seek returns the new offset relative 
+// Seek sets the offset for the next Read to offset,
+// interpreted according to whence: io.SeekStart means
+// relative to the start of the file, io.SeekCurrent means
+// relative to the current offset, and io.SeekEnd means
+// relative to the end. Seek returns the new offset relative
 // to the start of the file and an error, if any.
 func (f *File) Seek(offset int64, whence int) (int64, error) {
-	if maxSize < offset {
-		return 0, fmt.Errorf("invalid target offset: %d", offset)
+	data, err := f.data()
+	if err != nil {
+		return 0, err
 	}
+
 	newOffset := f.offset
 	if whence == io.SeekStart {
 		newOffset = offset
 	} else if whence == io.SeekEnd {
-		newOffset = int64(len(f.f.contents)) - offset
+		newOffset = int64(len(data)) + offset
 	} else if whence == io.SeekCurrent {
 		newOffset = f.offset + offset
 	} else {
 		return 0, fmt.Errorf("invalid seek whence: %d", whence)
 	}
 
-	if maxSize < newOffset || newOffset < 0 || int64(len(f.f.contents)) < newOffset {
+	if newOffset < 0 || int64(len(data)) < newOffset {
 		return 0, fmt.Errorf("invalid target offset: %d", newOffset)
 	}
 
@@ -351,68 +642,907 @@ func (f *File) Seek(offset int64, whence int) (int64, error) {
 	return f.offset, nil
 }
 
+// Close closes the file. The contents are held in memory, so
+// there is nothing to release and Close always returns nil.
+func (f *File) Close() error {
+	return nil
+}
+
+// Stat returns the fs.FileInfo describing the file, implementing
+// fs.File.
+func (f *File) Stat() (fs.FileInfo, error) {
+	return f, nil
+}
+
+// Name returns the base name of the file, implementing
+// fs.FileInfo.
+func (f *File) Name() string {
+	return path.Base(f.path)
+}
+
+// Mode returns the file mode captured from the source file at
+// generation time.
+func (f *File) Mode() fs.FileMode {
+	return fs.FileMode(f.f.mode)
+}
+
+// ModTime returns the modification time of the source file as
+// captured at generation time.
+func (f *File) ModTime() time.Time {
+	return time.Unix(f.f.modTime, 0)
+}
+
+// ContentType returns the MIME type sniffed from the file's
+// contents at generation time, as determined by
+// http.DetectContentType.
+func (f *File) ContentType() string {
+	return f.f.contentType
+}
+
+// Tag returns the value of the metadata tag with the given key, as
+// attached through a mapping's ::meta=path/to/tags.json file, or
+// the empty string if the file carries no such tag.
+func (f *File) Tag(key string) string {
+	return f.f.tags[key]
+}
+
+// IsDir always returns false; a *File never describes a
+// directory.
+func (f *File) IsDir() bool {
+	return false
+}
+
+// Sys returns nil; embedded files carry no underlying system
+// data.
+func (f *File) Sys() interface{} {
+	return nil
+}
+
 type file struct {
 	contents []byte
 	version string
+	modTime int64
+	size    int64
+	codec   string
+	mode        uint32
+	contentType string
+	tags        map[string]string
+}
+
+// decompress decodes b according to codec, returning the
+// original, uncompressed bytes. An unrecognized codec, including
+// the empty string, is treated as uncompressed and returns a
+// defensive copy of b.
+func decompress(b []byte, codec string) ([]byte, error) {
+	switch codec {
+	case "gzip":
+		r, err := gzip.NewReader(bytes.NewReader(b))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return io.ReadAll(r)
+	case "zstd":
+		r, err := zstd.NewReader(bytes.NewReader(b))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return io.ReadAll(r)
+	default:
+		out := make([]byte, len(b))
+		copy(out, b)
+		return out, nil
+	}
+}
+
+// mustDecodeBase64 decodes a base64 string emitted by the -base64
+// generator flag. A decode failure means the generated file is
+// corrupt, so mustDecodeBase64 panics rather than returning an
+// error that every call site would have to plumb through.
+func mustDecodeBase64(s string) []byte {
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		panic("govfs: corrupt base64 payload: " + err.Error())
+	}
+	return b
+}
+
+// dirEntry represents a directory synthesized at generation time
+// from the parents of every embedded file.
+type dirEntry struct {
+	path    string
+	modTime int64
+}
+
+// Name returns the base name of the directory, implementing
+// fs.FileInfo and fs.DirEntry.
+func (d *dirEntry) Name() string {
+	if d.path == "/" {
+		return "/"
+	}
+	return path.Base(d.path)
 }
 
-var store map[string]*file = map[string]*file{
+// Size always returns 0 for a directory.
+func (d *dirEntry) Size() int64 {
+	return 0
+}
+
+// Mode returns the directory's file mode.
+func (d *dirEntry) Mode() fs.FileMode {
+	return fs.ModeDir | 0555
+}
+
+// ModTime returns the time the directory was synthesized at
+// generation time.
+func (d *dirEntry) ModTime() time.Time {
+	return time.Unix(d.modTime, 0)
+}
+
+// IsDir always returns true for a dirEntry.
+func (d *dirEntry) IsDir() bool {
+	return true
+}
+
+// Sys returns nil; synthesized directories carry no underlying
+// system data.
+func (d *dirEntry) Sys() interface{} {
+	return nil
+}
+
+// Type implements fs.DirEntry.
+func (d *dirEntry) Type() fs.FileMode {
+	return fs.ModeDir
+}
+
+// Info implements fs.DirEntry.
+func (d *dirEntry) Info() (fs.FileInfo, error) {
+	return d, nil
+}
+
+// fileDirEntry adapts a *File to fs.DirEntry for directory
+// listings.
+type fileDirEntry struct {
+	f *File
+}
+
+func (e fileDirEntry) Name() string              { return e.f.Name() }
+func (e fileDirEntry) IsDir() bool                { return false }
+func (e fileDirEntry) Type() fs.FileMode          { return 0 }
+func (e fileDirEntry) Info() (fs.FileInfo, error) { return e.f, nil }
+
+// Dir represents an open directory, implementing fs.ReadDirFile.
+type Dir struct {
+	d       *dirEntry
+	entries []fs.DirEntry
+	offset  int
+}
+
+// Stat returns the fs.FileInfo describing the directory.
+func (d *Dir) Stat() (fs.FileInfo, error) {
+	return d.d, nil
+}
+
+// Read always fails; a directory cannot be read as a byte
+// stream.
+func (d *Dir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.d.path, Err: fmt.Errorf("is a directory")}
+}
+
+// Close closes the directory. The listing is held in memory, so
+// there is nothing to release and Close always returns nil.
+func (d *Dir) Close() error {
+	return nil
+}
+
+// ReadDir lists the directory entries, implementing
+// fs.ReadDirFile. If n > 0, ReadDir returns at most n entries and
+// advances its internal cursor so a later call picks up where it
+// left off; if n <= 0, it returns all remaining entries at once.
+func (d *Dir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if n <= 0 {
+		entries := d.entries[d.offset:]
+		d.offset = len(d.entries)
+		return entries, nil
+	}
+
+	remaining := len(d.entries) - d.offset
+	if remaining == 0 {
+		return nil, io.EOF
+	}
+	if n > remaining {
+		n = remaining
+	}
+	entries := d.entries[d.offset : d.offset+n]
+	d.offset += n
+	return entries, nil
+}
+
+var store = map[string]*file{}
 `
 
 func (v *vfs) writeFooter() error {
 	if v.w == nil {
 		return nil
 	}
-	_, err := fmt.Fprintln(v.w, "}")
-	return err
+	if err := v.closeShard(); err != nil {
+		return err
+	}
+
+	dirs := make([]string, 0, len(v.dirs))
+	for d := range v.dirs {
+		dirs = append(dirs, d)
+	}
+	sort.Strings(dirs)
+
+	if _, err := fmt.Fprintln(v.w, "\nvar dirStore map[string]*dirEntry = map[string]*dirEntry{"); err != nil {
+		return err
+	}
+	for _, d := range dirs {
+		_, err := fmt.Fprintf(v.w, "\t%q: {path: %q, modTime: %d},\n", d, d, v.genTime.Unix())
+		if err != nil {
+			return err
+		}
+	}
+	if _, err := fmt.Fprintln(v.w, "}"); err != nil {
+		return err
+	}
+
+	if err := v.writeEmbeds(); err != nil {
+		return err
+	}
+
+	if _, err := fmt.Fprint(v.w, tmplFS); err != nil {
+		return err
+	}
+
+	if v.overlay {
+		_, err := fmt.Fprint(v.w, tmplOverlay)
+		return err
+	}
+	return nil
+}
+
+// writeEmbeds emits one //go:embed-backed variable per file staged
+// by stageEmbedAsset, in the order they were staged. The init
+// functions that fill store, in this file or in a shard file,
+// refer to these package-level variables by name.
+func (v *vfs) writeEmbeds() error {
+	if len(v.embeds) == 0 {
+		return nil
+	}
+	if _, err := fmt.Fprintln(v.w); err != nil {
+		return err
+	}
+	for _, e := range v.embeds {
+		_, err := fmt.Fprintf(v.w, "//go:embed %q\nvar %s []byte\n", e.stagedPath, e.varName)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tmplFS is appended verbatim after the store and dirStore map
+// literals. It has no template variables of its own; it only
+// relies on those two package-level maps being populated.
+var tmplFS = `
+// FS is an fs.FS view of the embedded virtual file system,
+// backed by store and the directories synthesized at generation
+// time.
+type FS struct{}
+
+// NewFS returns an fs.FS view of the embedded virtual file
+// system.
+func NewFS() FS {
+	return FS{}
+}
+
+func cleanFSPath(name string) (string, error) {
+	if name == "." {
+		return "/", nil
+	}
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	return "/" + name, nil
 }
 
-func (v *vfs) writeFile(target, src string, size int64) (string, error) {
+// Open opens the named file or directory, implementing fs.FS.
+func (FS) Open(name string) (fs.File, error) {
+	p, err := cleanFSPath(name)
+	if err != nil {
+		return nil, err
+	}
+	if f, ok := store[p]; ok {
+		return &File{f: f, path: p}, nil
+	}
+	if d, ok := dirStore[p]; ok {
+		return &Dir{d: d, entries: readDirEntries(p)}, nil
+	}
+	return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+}
+
+// ReadDir reads and returns the entries of the named directory,
+// implementing fs.ReadDirFS.
+func (fsys FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	p, err := cleanFSPath(name)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := dirStore[p]; !ok {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+	return readDirEntries(p), nil
+}
+
+// Stat returns the fs.FileInfo for the named file or directory,
+// implementing fs.StatFS.
+func (fsys FS) Stat(name string) (fs.FileInfo, error) {
+	p, err := cleanFSPath(name)
+	if err != nil {
+		return nil, err
+	}
+	if f, ok := store[p]; ok {
+		return &File{f: f, path: p}, nil
+	}
+	if d, ok := dirStore[p]; ok {
+		return d, nil
+	}
+	return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+}
+
+// ReadFile reads and returns the contents of the named file,
+// implementing fs.ReadFileFS.
+func (fsys FS) ReadFile(name string) ([]byte, error) {
+	p, err := cleanFSPath(name)
+	if err != nil {
+		return nil, err
+	}
+	f, ok := store[p]
+	if !ok {
+		return nil, &fs.PathError{Op: "readfile", Path: name, Err: fs.ErrNotExist}
+	}
+	return decompress(f.contents, f.codec)
+}
+
+// Glob returns the names of all files matching pattern,
+// implementing fs.GlobFS.
+func (fsys FS) Glob(pattern string) ([]string, error) {
+	var matches []string
+	for p := range store {
+		name := strings.TrimPrefix(p, "/")
+		ok, err := path.Match(pattern, name)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			matches = append(matches, name)
+		}
+	}
+	for p := range dirStore {
+		if p == "/" {
+			continue
+		}
+		name := strings.TrimPrefix(p, "/")
+		ok, err := path.Match(pattern, name)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			matches = append(matches, name)
+		}
+	}
+	sort.Strings(matches)
+	return matches, nil
+}
+
+// readDirEntries returns the sorted, direct children of dir.
+func readDirEntries(dir string) []fs.DirEntry {
+	prefix := dir
+	if prefix != "/" {
+		prefix += "/"
+	}
+
+	var entries []fs.DirEntry
+	for p, f := range store {
+		if isDirectChild(prefix, p) {
+			entries = append(entries, fileDirEntry{f: &File{f: f, path: p}})
+		}
+	}
+	for p, d := range dirStore {
+		if p != dir && isDirectChild(prefix, p) {
+			entries = append(entries, d)
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries
+}
+
+func isDirectChild(prefix, p string) bool {
+	if !strings.HasPrefix(p, prefix) {
+		return false
+	}
+	rest := strings.TrimPrefix(p, prefix)
+	return rest != "" && !strings.Contains(rest, "/")
+}
+`
+
+// tmplOverlay is appended verbatim when -overlay is set. Like
+// tmplFS, it has no template variables of its own; it only
+// relies on store and dirStore being populated.
+var tmplOverlay = `
+// overlayFileMode is the mode reported for every file created
+// through an Overlay.
+const overlayFileMode = fs.FileMode(0644)
+
+// overlayFile holds the buffered, writable contents of a file
+// created or modified in an Overlay.
+type overlayFile struct {
+	contents    []byte
+	modTime     int64
+	contentType string
+}
+
+// Overlay wraps the embedded, read-only store with an in-memory
+// writable layer, inspired by afero's CopyOnWriteFs. Reads check
+// the overlay first, then fall through to the embedded store;
+// writes always go to the overlay, and removals are recorded as
+// tombstones so an embedded file can be hidden without mutating
+// the embedded store.
+type Overlay struct {
+	mu        sync.RWMutex
+	files     map[string]*overlayFile
+	dirs      map[string]int64
+	tombstone map[string]bool
+}
+
+// NewOverlay returns an Overlay backed by the embedded store.
+func NewOverlay() *Overlay {
+	return &Overlay{
+		files:     map[string]*overlayFile{},
+		dirs:      map[string]int64{},
+		tombstone: map[string]bool{},
+	}
+}
+
+// Open opens the named file or directory, checking the overlay
+// before falling through to the embedded store, implementing
+// fs.FS.
+func (o *Overlay) Open(name string) (fs.File, error) {
+	p, err := cleanFSPath(name)
+	if err != nil {
+		return nil, err
+	}
+
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+
+	if o.tombstone[p] {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	if f, ok := o.files[p]; ok {
+		return &File{f: &file{contents: f.contents, modTime: f.modTime, size: int64(len(f.contents)), mode: uint32(overlayFileMode), contentType: f.contentType}, path: p}, nil
+	}
+	if modTime, ok := o.dirs[p]; ok {
+		return &Dir{d: &dirEntry{path: p, modTime: modTime}, entries: o.readDir(p)}, nil
+	}
+	if f, ok := store[p]; ok {
+		return &File{f: f, path: p}, nil
+	}
+	if d, ok := dirStore[p]; ok {
+		return &Dir{d: d, entries: o.readDir(p)}, nil
+	}
+	return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+}
+
+// Create creates or truncates the named file in the overlay
+// layer and returns a handle for writing to it. Parent
+// directories are not created implicitly; call Mkdir first.
+func (o *Overlay) Create(name string) (*OverlayFile, error) {
+	p, err := cleanFSPath(name)
+	if err != nil {
+		return nil, err
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	delete(o.tombstone, p)
+	f := &overlayFile{modTime: time.Now().Unix()}
+	o.files[p] = f
+	return &OverlayFile{o: o, f: f}, nil
+}
+
+// Remove deletes the named file or directory from the virtual
+// file system. It records a tombstone so an embedded entry with
+// the same path is hidden, without mutating the embedded store.
+// Removing a directory tombstones only the directory's own path;
+// entries beneath it can still be opened by their full paths.
+func (o *Overlay) Remove(name string) error {
+	p, err := cleanFSPath(name)
+	if err != nil {
+		return err
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	_, inOverlay := o.files[p]
+	_, dirInOverlay := o.dirs[p]
+	_, inStore := store[p]
+	_, inDirStore := dirStore[p]
+	if !inOverlay && !dirInOverlay && !inStore && !inDirStore {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	}
+
+	delete(o.files, p)
+	delete(o.dirs, p)
+	o.tombstone[p] = true
+	return nil
+}
+
+// Mkdir creates the named directory in the overlay layer.
+func (o *Overlay) Mkdir(name string) error {
+	p, err := cleanFSPath(name)
+	if err != nil {
+		return err
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	delete(o.tombstone, p)
+	o.dirs[p] = time.Now().Unix()
+	return nil
+}
+
+// Rename moves oldname to newname. If oldname only exists in the
+// embedded store, its contents are copied into the overlay under
+// newname (copy-on-write) and oldname is tombstoned.
+func (o *Overlay) Rename(oldname, newname string) error {
+	op, err := cleanFSPath(oldname)
+	if err != nil {
+		return err
+	}
+	np, err := cleanFSPath(newname)
+	if err != nil {
+		return err
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.tombstone[op] {
+		return &fs.PathError{Op: "rename", Path: oldname, Err: fs.ErrNotExist}
+	}
+	if f, ok := o.files[op]; ok {
+		delete(o.files, op)
+		o.files[np] = f
+		delete(o.tombstone, np)
+		o.tombstone[op] = true
+		return nil
+	}
+	if f, ok := store[op]; ok {
+		data, err := decompress(f.contents, f.codec)
+		if err != nil {
+			return err
+		}
+		o.files[np] = &overlayFile{contents: data, modTime: time.Now().Unix(), contentType: f.contentType}
+		delete(o.tombstone, np)
+		o.tombstone[op] = true
+		return nil
+	}
+	return &fs.PathError{Op: "rename", Path: oldname, Err: fs.ErrNotExist}
+}
+
+// readDir returns the sorted, direct children of dir, merging the
+// embedded store and dirStore with the overlay layer and
+// excluding anything tombstoned. o.mu must already be held.
+func (o *Overlay) readDir(dir string) []fs.DirEntry {
+	prefix := dir
+	if prefix != "/" {
+		prefix += "/"
+	}
+
+	seen := map[string]bool{}
+	var entries []fs.DirEntry
+
+	for p, f := range store {
+		if _, inOverlay := o.files[p]; inOverlay || o.tombstone[p] || !isDirectChild(prefix, p) {
+			continue
+		}
+		entries = append(entries, fileDirEntry{f: &File{f: f, path: p}})
+		seen[p] = true
+	}
+	for p, d := range dirStore {
+		if p == dir || o.tombstone[p] || seen[p] || !isDirectChild(prefix, p) {
+			continue
+		}
+		entries = append(entries, d)
+		seen[p] = true
+	}
+	for p, f := range o.files {
+		if o.tombstone[p] || seen[p] || !isDirectChild(prefix, p) {
+			continue
+		}
+		entries = append(entries, fileDirEntry{f: &File{f: &file{contents: f.contents, modTime: f.modTime, size: int64(len(f.contents)), mode: uint32(overlayFileMode), contentType: f.contentType}, path: p}})
+		seen[p] = true
+	}
+	for p, modTime := range o.dirs {
+		if p == dir || o.tombstone[p] || seen[p] || !isDirectChild(prefix, p) {
+			continue
+		}
+		entries = append(entries, &dirEntry{path: p, modTime: modTime})
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries
+}
+
+// OverlayFile is a writable file handle returned by
+// Overlay.Create.
+type OverlayFile struct {
+	o      *Overlay
+	f      *overlayFile
+	offset int64
+}
+
+// Write appends b to the file's buffered contents at the current
+// offset, growing the file as needed.
+func (w *OverlayFile) Write(b []byte) (int, error) {
+	w.o.mu.Lock()
+	defer w.o.mu.Unlock()
+
+	end := int(w.offset) + len(b)
+	if end > len(w.f.contents) {
+		grown := make([]byte, end)
+		copy(grown, w.f.contents)
+		w.f.contents = grown
+	}
+	copy(w.f.contents[w.offset:end], b)
+	w.offset += int64(len(b))
+	return len(b), nil
+}
+
+// Close flushes the write, recording the final modification
+// time and sniffing the content type from the written bytes. The
+// contents are already held in memory, so there is nothing else to
+// release.
+func (w *OverlayFile) Close() error {
+	w.o.mu.Lock()
+	defer w.o.mu.Unlock()
+	w.f.modTime = time.Now().Unix()
+	w.f.contentType = http.DetectContentType(w.f.contents)
+	return nil
+}
+`
+
+func (v *vfs) writeFile(target, src string, info os.FileInfo, codec string, tags map[string]string) (string, error) {
 	version := ""
 
 	if v.w == nil {
 		return version, nil
 	}
 
-	if maxSize < size {
-		return version, fmt.Errorf("maximum allowed size exceeded: %v", maxSize)
-	}
-
 	f, err := os.Open(src)
 	if err != nil {
 		return version, err
 	}
 	defer f.Close()
 
-	_, err = fmt.Fprintf(v.w, "\t\"%s\": &file{\n\t\tcontents: []byte{", target)
+	hash := adler32.New()
+	var sniff bytes.Buffer
+	var compressed bytes.Buffer
+	cw, err := newCompressWriter(&compressed, codec)
 	if err != nil {
 		return version, err
 	}
 
-	hash := adler32.New()
-
 	for {
 		n, err := f.Read(v.buf)
 		if err != nil && err != io.EOF {
 			return version, err
 		}
+		if n > 0 {
+			if _, err := hash.Write(v.buf[0:n]); err != nil {
+				return version, err
+			}
+			if sniff.Len() < 512 {
+				sniff.Write(v.buf[0:n])
+			}
+			if _, err := cw.Write(v.buf[0:n]); err != nil {
+				return version, err
+			}
+		}
 		if err == io.EOF {
 			break
 		}
-		_, err = hash.Write(v.buf[0:n])
-		if err != nil {
+	}
+	if err := cw.Close(); err != nil {
+		return version, err
+	}
+	version = fmt.Sprintf("%x", hash.Sum(nil))
+	contentType := http.DetectContentType(sniff.Bytes())
+
+	if err := v.beginShard(); err != nil {
+		return version, err
+	}
+
+	var written int64
+	n, err := fmt.Fprintf(v.dataW, "\tstore[%q] = &file{\n\t\tcontents: ", target)
+	written += int64(n)
+	if err != nil {
+		return version, err
+	}
+
+	n, err = v.writeContents(target, compressed.Bytes())
+	written += int64(n)
+	if err != nil {
+		return version, err
+	}
+
+	n, err = fmt.Fprintf(v.dataW,
+		",\n\t\tversion: \"%s\",\n\t\tmodTime: %d,\n\t\tsize: %d,\n\t\tcodec: %q,\n\t\tmode: %d,\n\t\tcontentType: %q,\n\t\ttags: %#v,\n\t}\n",
+		version, info.ModTime().Unix(), info.Size(), codec, uint32(info.Mode()), contentType, tags)
+	written += int64(n)
+	if err != nil {
+		return version, err
+	}
+
+	v.shardByteCount += written
+	v.shardFileCount++
+	if (v.shardBytesLimit > 0 && v.shardByteCount >= v.shardBytesLimit) ||
+		(v.shardFilesLimit > 0 && v.shardFileCount >= v.shardFilesLimit) {
+		if err := v.closeShard(); err != nil {
 			return version, err
 		}
-		for _, b := range v.buf[0:n] {
-			_, err := fmt.Fprintf(v.w, "%d, ", b)
-			if err != nil {
-				return version, err
-			}
+		v.shardRotatePending = true
+	}
+
+	return version, nil
+}
+
+// writeContents emits the Go expression that reconstructs
+// payload as a []byte, using the encoding selected by v.encoding.
+// It returns the number of bytes written, so callers can track
+// shard size.
+func (v *vfs) writeContents(target string, payload []byte) (int, error) {
+	switch v.encoding {
+	case encodingBase64:
+		return fmt.Fprintf(v.dataW, "mustDecodeBase64(%q)", base64.StdEncoding.EncodeToString(payload))
+	case encodingEmbed:
+		varName := fmt.Sprintf("embedAsset%d", len(v.embeds))
+		stagedPath := path.Join("embedassets", strings.TrimPrefix(target, "/"))
+		if err := v.stageEmbedAsset(stagedPath, payload); err != nil {
+			return 0, err
 		}
+		v.embeds = append(v.embeds, embedAsset{varName: varName, stagedPath: stagedPath})
+		return fmt.Fprint(v.dataW, varName)
+	default:
+		return fmt.Fprintf(v.dataW, "[]byte(%s)", strconv.Quote(string(payload)))
 	}
-	version = fmt.Sprintf("%x", hash.Sum(nil))
-	_, err = fmt.Fprintf(v.w, "},\n\t\tversion: \"%s\",\n\t},\n", version)
-	return version, err
+}
+
+// beginShard lazily opens the destination for store entries. The
+// first shard is written straight into the main output file; it is
+// only when a later file actually needs writing, after the previous
+// shard hit its limit, that a rotation happens and a new
+// vfs_data_NNN.go file is created. This keeps a shard limit that's
+// hit on the very last file from producing an empty trailing file.
+func (v *vfs) beginShard() error {
+	if v.dataW != nil {
+		return nil
+	}
+	if v.shardRotatePending {
+		v.shardIndex++
+		v.shardByteCount = 0
+		v.shardFileCount = 0
+		v.shardRotatePending = false
+	}
+	return v.openShard()
+}
+
+func (v *vfs) openShard() error {
+	if v.shardIndex == 0 {
+		if _, err := fmt.Fprint(v.w, "\nfunc init() {\n"); err != nil {
+			return err
+		}
+		v.dataW = v.w
+		return nil
+	}
+
+	name := v.shardFileName(v.shardIndex)
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(f)
+	_, err = fmt.Fprintf(bw, "// Code generated with govfs. DO NOT EDIT.\n\npackage %s\n\nfunc init() {\n", v.pkgName)
+	if err != nil {
+		return err
+	}
+
+	v.shardFile = f
+	v.shardBufWriter = bw
+	v.dataW = bw
+	return nil
+}
+
+// closeShard closes the init function for the current shard and,
+// if it was written to a separate vfs_data_NNN.go file, flushes
+// and closes that file.
+func (v *vfs) closeShard() error {
+	if v.dataW == nil {
+		return nil
+	}
+	if _, err := fmt.Fprint(v.dataW, "}\n"); err != nil {
+		return err
+	}
+	if v.shardBufWriter != nil {
+		if err := v.shardBufWriter.Flush(); err != nil {
+			return err
+		}
+	}
+	if v.shardFile != nil {
+		if err := v.shardFile.Close(); err != nil {
+			return err
+		}
+	}
+	v.dataW = nil
+	v.shardFile = nil
+	v.shardBufWriter = nil
+	return nil
+}
+
+// shardFileName returns the path of the Nth sibling data file,
+// e.g. vfs.go -> vfs_data_001.go for index 1.
+func (v *vfs) shardFileName(index int) string {
+	base := filepath.Base(v.outputPath)
+	ext := filepath.Ext(base)
+	stem := strings.TrimSuffix(base, ext)
+	return filepath.Join(v.outputDir, fmt.Sprintf("%s_data_%03d%s", stem, index, ext))
+}
+
+// stageEmbedAsset writes payload to stagedPath, relative to the
+// output file's directory, so a //go:embed directive emitted in
+// the footer can pick it up at compile time.
+func (v *vfs) stageEmbedAsset(stagedPath string, payload []byte) error {
+	fullPath := filepath.Join(v.outputDir, filepath.FromSlash(stagedPath))
+	if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(fullPath, payload, 0644)
+}
+
+type embedAsset struct {
+	varName    string
+	stagedPath string
+}
+
+// newCompressWriter returns a writer that compresses everything
+// written to it with the given codec before forwarding it to w.
+// An unrecognized codec, including the empty string, is treated
+// as codecNone.
+func newCompressWriter(w io.Writer, codec string) (io.WriteCloser, error) {
+	switch codec {
+	case codecGzip:
+		return gzip.NewWriter(w), nil
+	case codecZstd:
+		return zstd.NewWriter(w)
+	default:
+		return nopWriteCloser{w}, nil
+	}
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
 }
 
 type vfsTests struct {
@@ -519,6 +1649,14 @@ func TestSeeker(t *testing.T) {
 	if size != expectedSize {
 		t.Fatalf("expected size %v, but got %v", expectedSize, size)
 	}
+
+	start, err := f.Seek(-expectedSize, io.SeekEnd)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if start != 0 {
+		t.Fatalf("expected offset %v, but got %v", 0, start)
+	}
 }
 `
 